@@ -0,0 +1,229 @@
+package caddy_geoip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+
+	"go.uber.org/zap"
+)
+
+// Interface guards
+var (
+	_ caddy.Module                = (*LookupAPI)(nil)
+	_ caddy.Provisioner           = (*LookupAPI)(nil)
+	_ caddyhttp.MiddlewareHandler = (*LookupAPI)(nil)
+	_ caddyfile.Unmarshaler       = (*LookupAPI)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(LookupAPI{})
+	httpcaddyfile.RegisterHandlerDirective("geoip_api", parseLookupAPICaddyfile)
+}
+
+// LookupAPI serves a small JSON API, e.g. routed at `/geoip/lookup`, that
+// answers "where is this IP" using the same shared GeoIP database state as
+// the geoip handler and matcher, so standalone geolocation lookups don't
+// need their own microservice.
+type LookupAPI struct {
+	// The value sent as the Access-Control-Allow-Origin header. Default "*".
+	CorsOrigin string `json:"cors_origin,omitempty"`
+
+	// Maximum requests per second allowed per client IP. 0 (default)
+	// disables rate limiting.
+	RateLimit float64 `json:"rate_limit,omitempty"`
+
+	// The header to trust instead of the `RemoteAddr`
+	TrustHeader string `json:"trust_header,omitempty"`
+
+	logger  *zap.Logger
+	state   *state
+	limiter *rateLimiter
+}
+
+// lookupResponse is the JSON body returned for a lookup.
+type lookupResponse struct {
+	IP          string  `json:"ip"`
+	Country     string  `json:"country,omitempty"`
+	Subdivision string  `json:"subdivision,omitempty"`
+	City        string  `json:"city,omitempty"`
+	Latitude    float64 `json:"latitude,omitempty"`
+	Longitude   float64 `json:"longitude,omitempty"`
+	Asn         uint    `json:"asn,omitempty"`
+	Aso         string  `json:"aso,omitempty"`
+}
+
+func (LookupAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.geoip_api",
+		New: func() caddy.Module { return new(LookupAPI) },
+	}
+}
+
+func (m *LookupAPI) Provision(ctx caddy.Context) error {
+	m.logger = ctx.Logger(m)
+
+	if m.CorsOrigin == "" {
+		m.CorsOrigin = "*"
+	}
+
+	if m.RateLimit > 0 {
+		m.limiter = newRateLimiter(m.RateLimit)
+	}
+
+	// Share the same state as the geoip handler/matcher so we don't reopen
+	// the database. As with the matcher, this may create an unconfigured
+	// placeholder if no geoip handler has been provisioned yet; it becomes
+	// live once one is (see state.ensureProvisioned), regardless of order.
+	tmp, _, err := pool.LoadOrNew("geoip.state", func() (caddy.Destructor, error) {
+		return &state{logger: m.logger}, nil
+	})
+	if err != nil {
+		m.logger.Error("unable to load geoip state", zap.Error(err))
+		return err
+	}
+	if s, ok := tmp.(*state); ok {
+		m.state = s
+	}
+
+	return nil
+}
+
+// resolveRemote returns the request's address, honoring TrustHeader when set.
+func (m *LookupAPI) resolveRemote(r *http.Request) string {
+	remote := r.RemoteAddr
+	if m.TrustHeader != "" && r.Header.Get(m.TrustHeader) != "" {
+		remote = r.Header.Get(m.TrustHeader)
+	}
+	return remote
+}
+
+// callerIP resolves the actual caller's address, for use as the rate
+// limiter key. It must never be influenced by the `?ip=` query override -
+// otherwise a client could dodge its bucket just by varying the IP it asks
+// us to look up.
+func (m *LookupAPI) callerIP(r *http.Request) string {
+	remote := m.resolveRemote(r)
+	if ipStr, _, err := net.SplitHostPort(remote); err == nil {
+		return ipStr
+	}
+	return remote // OK; probably didn't have a port
+}
+
+// clientIP resolves the IP to look up: the `?ip=` query parameter if given,
+// otherwise the trusted header or RemoteAddr, same as the geoip handler.
+func (m *LookupAPI) clientIP(r *http.Request) (net.IP, string, error) {
+	remote := m.resolveRemote(r)
+
+	if q := r.URL.Query().Get("ip"); q != "" {
+		remote = q
+	}
+
+	ipStr, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		ipStr = remote // OK; probably didn't have a port
+	}
+
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return nil, ipStr, fmt.Errorf("invalid IP address: %s", ipStr)
+	}
+	return ip, ipStr, nil
+}
+
+func (m *LookupAPI) writeJSON(w http.ResponseWriter, status int, body interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(body)
+}
+
+func (m *LookupAPI) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	w.Header().Set("Access-Control-Allow-Origin", m.CorsOrigin)
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	if m.limiter != nil && !m.limiter.Allow(m.callerIP(r)) {
+		return m.writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "rate limit exceeded"})
+	}
+
+	ip, ipStr, err := m.clientIP(r)
+	if err != nil {
+		m.logger.Warn("cannot parse IP address", zap.String("address", ipStr), zap.Error(err))
+		return m.writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	resp := lookupResponse{IP: ip.String()}
+
+	if m.state != nil {
+		var record Record
+		if err := m.state.lookupCountry(ip, &record); err != nil {
+			if err != errNoDatabase {
+				m.logger.Warn("cannot lookup IP address", zap.String("ip", ip.String()), zap.Error(err))
+			}
+		} else {
+			resp.Country = record.Country.ISOCode
+			resp.Subdivision = record.subdivisionCode()
+			resp.City = record.cityName()
+			resp.Latitude = record.Location.Latitude
+			resp.Longitude = record.Location.Longitude
+		}
+	}
+
+	if m.state != nil {
+		var asnRecord AsnRecord
+		if err := m.state.lookupAsn(ip, &asnRecord); err != nil {
+			if err != errNoDatabase {
+				m.logger.Warn("cannot lookup ASN for IP address", zap.String("ip", ip.String()), zap.Error(err))
+			}
+		} else {
+			resp.Asn = asnRecord.AutonomousSystemNumber
+			resp.Aso = asnRecord.AutonomousSystemOrganization
+		}
+	}
+
+	return m.writeJSON(w, http.StatusOK, resp)
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+func (m *LookupAPI) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.NextArg()
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "cors_origin":
+			d.Args(&m.CorsOrigin)
+
+		case "rate_limit":
+			var val string
+			if d.Args(&val) {
+				f, err := strconv.ParseFloat(val, 64)
+				if err != nil {
+					return d.Errf("invalid rate limit %s: %v", val, err)
+				}
+				m.RateLimit = f
+			}
+
+		case "trust_header":
+			d.Args(&m.TrustHeader)
+		}
+	}
+	return nil
+}
+
+// parseLookupAPICaddyfile unmarshals tokens from h into a new LookupAPI.
+func parseLookupAPICaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var m LookupAPI
+	err := m.UnmarshalCaddyfile(h.Dispenser)
+	return &m, err
+}
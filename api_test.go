@@ -0,0 +1,113 @@
+package caddy_geoip
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddytest"
+)
+
+func TestLookupAPIJson(t *testing.T) {
+	tester := caddytest.NewTester(t)
+
+	cfg := `
+		{
+			http_port     8080
+			https_port    8443
+			order geo_ip first
+			order geoip_api last
+		}
+
+		localhost:8080 {
+
+			geo_ip {
+			  db_path 					GeoLite2-Country.mmdb
+			}
+
+			handle /geoip/lookup {
+				geoip_api
+			}
+		}
+	`
+
+	tester.InitServer(cfg, "caddyfile")
+
+	req, err := http.NewRequest("GET", "http://localhost:8080/geoip/lookup?ip=202.36.75.151", nil)
+	if err != nil {
+		t.Fatalf("unable to create request %s", err)
+	}
+
+	tester.AssertResponse(req, 200, "{\"ip\":\"202.36.75.151\",\"country\":\"NZ\"}\n")
+}
+
+func TestLookupAPICorsPreflight(t *testing.T) {
+	tester := caddytest.NewTester(t)
+
+	cfg := `
+		{
+			http_port     8080
+			https_port    8443
+			order geoip_api last
+		}
+
+		localhost:8080 {
+			handle /geoip/lookup {
+				geoip_api {
+					cors_origin https://example.com
+				}
+			}
+		}
+	`
+
+	tester.InitServer(cfg, "caddyfile")
+
+	req, err := http.NewRequest("OPTIONS", "http://localhost:8080/geoip/lookup", nil)
+	if err != nil {
+		t.Fatalf("unable to create request %s", err)
+	}
+
+	resp, _ := tester.AssertResponse(req, 204, "")
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "https://example.com" {
+		t.Errorf("expected Access-Control-Allow-Origin \"https://example.com\" but got %q", got)
+	}
+}
+
+// TestLookupAPIRateLimitPerCaller ensures the rate limiter is keyed on the
+// actual caller, not the `?ip=` query parameter - otherwise a client could
+// dodge its bucket by varying the IP it asks us to look up.
+func TestLookupAPIRateLimitPerCaller(t *testing.T) {
+	tester := caddytest.NewTester(t)
+
+	cfg := `
+		{
+			http_port     8080
+			https_port    8443
+			order geoip_api last
+		}
+
+		localhost:8080 {
+			handle /geoip/lookup {
+				geoip_api {
+					rate_limit 1
+					trust_header X-Real-IP
+				}
+			}
+		}
+	`
+
+	tester.InitServer(cfg, "caddyfile")
+
+	req1, err := http.NewRequest("GET", "http://localhost:8080/geoip/lookup?ip=202.36.75.151", nil)
+	if err != nil {
+		t.Fatalf("unable to create request %s", err)
+	}
+	req1.Header.Add("X-Real-IP", "203.0.113.5")
+	tester.AssertResponseCode(req1, 200)
+
+	req2, err := http.NewRequest("GET", "http://localhost:8080/geoip/lookup?ip=8.8.8.8", nil)
+	if err != nil {
+		t.Fatalf("unable to create request %s", err)
+	}
+	req2.Header.Add("X-Real-IP", "203.0.113.5")
+	tester.AssertResponseCode(req2, 429)
+}
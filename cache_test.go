@@ -0,0 +1,77 @@
+package caddy_geoip
+
+import (
+	"net"
+	"testing"
+
+	"github.com/hashicorp/golang-lru"
+	"github.com/oschwald/maxminddb-golang"
+	"go.uber.org/zap"
+)
+
+func TestStateLookupCachesRecords(t *testing.T) {
+	db, err := maxminddb.Open("GeoLite2-Country.mmdb")
+	if err != nil {
+		t.Fatalf("opening test database: %v", err)
+	}
+	defer db.Close()
+
+	cache, err := lru.New(defaultCacheSize)
+	if err != nil {
+		t.Fatalf("creating cache: %v", err)
+	}
+
+	s := &state{dbInst: db, cache: cache, logger: zap.NewNop()}
+	addr := net.ParseIP("202.36.75.151")
+
+	_, hit, err := s.lookup(addr)
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	if hit {
+		t.Fatal("expected first lookup to be a cache miss")
+	}
+
+	entry, hit, err := s.lookup(addr)
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	if !hit {
+		t.Fatal("expected second lookup for the same IP to be a cache hit")
+	}
+	if entry.record.Country.ISOCode != "NZ" {
+		t.Fatalf("expected cached record's country to be NZ, got %q", entry.record.Country.ISOCode)
+	}
+}
+
+func TestStateLookupCachePurgedOnReload(t *testing.T) {
+	db, err := maxminddb.Open("GeoLite2-Country.mmdb")
+	if err != nil {
+		t.Fatalf("opening test database: %v", err)
+	}
+	defer db.Close()
+
+	cache, err := lru.New(defaultCacheSize)
+	if err != nil {
+		t.Fatalf("creating cache: %v", err)
+	}
+
+	s := &state{dbInst: db, cache: cache, logger: zap.NewNop()}
+	addr := net.ParseIP("202.36.75.151")
+
+	if _, _, err := s.lookup(addr); err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	if s.cache.Len() != 1 {
+		t.Fatalf("expected 1 cached entry, got %d", s.cache.Len())
+	}
+
+	s.db = dbSource{local: "GeoLite2-Country.mmdb"}
+	if err := s.reloadOne(&s.db, &s.dbInst, "database"); err != nil {
+		t.Fatalf("reloadOne: %v", err)
+	}
+
+	if s.cache.Len() != 0 {
+		t.Fatalf("expected reload to purge the cache, still have %d entries", s.cache.Len())
+	}
+}
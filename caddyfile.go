@@ -22,6 +22,11 @@ func (m *GeoIP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.Errf("Missing db path")
 			}
 
+		case "asn_db_path":
+			if !d.Args(&m.AsnDbPath) {
+				return d.Errf("Missing asn db path")
+			}
+
 		case "trust_header":
 			d.Args(&m.TrustHeader)
 
@@ -38,6 +43,9 @@ func (m *GeoIP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		case "api_key":
 			d.Args(&m.APIKey)
 
+		case "update_url":
+			d.Args(&m.UpdateURL)
+
 		case "reload_frequency":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -58,9 +66,29 @@ func (m *GeoIP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			}
 			m.DownloadFrequency = caddy.Duration(dur)
 
+		case "asn_download_frequency":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("bad duration value %s: %v", d.Val(), err)
+			}
+			m.AsnDownloadFrequency = caddy.Duration(dur)
+
 		case "override_country_code":
 			d.Args(&m.OverrideCountryCode)
 
+		case "cache_size":
+			var val string
+			if d.Args(&val) {
+				size, err := strconv.Atoi(val)
+				if err != nil {
+					return d.Errf("invalid cache size %s: %v", d.Val(), err)
+				}
+				m.CacheSize = size
+			}
+
 		}
 		if err != nil {
 			return d.Errf("Error parsing %s: %s", d.Val(), err)
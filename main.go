@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -24,6 +25,62 @@ var (
 	pool = caddy.NewUsagePool()
 )
 
+// Record is the subset of the GeoLite2-Country/GeoLite2-City schema that we
+// care about. The City, Subdivisions, Postal and Location fields are only
+// populated when looked up against a City database; they are simply left
+// zero-valued when looked up against a Country database.
+type Record struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+
+	Country struct {
+		ISOCode   string `maxminddb:"iso_code"`
+		GeonameId uint   `maxminddb:"geoname_id"`
+	} `maxminddb:"country"`
+
+	RegisteredCountry struct {
+		ISOCode   string `maxminddb:"iso_code"`
+		GeonameId uint   `maxminddb:"geoname_id"`
+	} `maxminddb:"registered_country"`
+
+	Subdivisions []struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+
+	Postal struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"postal"`
+
+	Location struct {
+		Latitude       float64 `maxminddb:"latitude"`
+		Longitude      float64 `maxminddb:"longitude"`
+		TimeZone       string  `maxminddb:"time_zone"`
+		AccuracyRadius uint16  `maxminddb:"accuracy_radius"`
+	} `maxminddb:"location"`
+}
+
+// cityName returns the English city name, or "" if the record has none.
+func (r Record) cityName() string {
+	return r.City.Names["en"]
+}
+
+// subdivisionCode returns the ISO code of the first (most specific)
+// subdivision, or "" if the record has none.
+func (r Record) subdivisionCode() string {
+	if len(r.Subdivisions) == 0 {
+		return ""
+	}
+	return r.Subdivisions[0].ISOCode
+}
+
+// AsnRecord is the subset of the GeoLite2-ASN schema that we care about.
+type AsnRecord struct {
+	AutonomousSystemNumber       uint   `maxminddb:"autonomous_system_number"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+}
+
 func init() {
 	caddy.RegisterModule(GeoIP{})
 	httpcaddyfile.RegisterHandlerDirective("geo_ip", parseCaddyfile)
@@ -38,15 +95,32 @@ type GeoIP struct {
 	// The API Key used to download the latest file
 	APIKey string `json:"api_key"`
 
-	// The path of the MaxMind GeoLite2-Country.mmdb file.
+	// The MaxMind GeoLite2-Country.mmdb database source: a plain filesystem
+	// path, a `file://` URL, or an `http(s)://` URL to a mirror that is
+	// polled on each reload.
 	DbPath string `json:"db_path"`
 
+	// The GeoLite2-ASN.mmdb database source, in the same formats as DbPath.
+	// Optional - when unset, the `geoip.asn` placeholder is set to "0" and
+	// `geoip.aso` to "--".
+	AsnDbPath string `json:"asn_db_path"`
+
+	// Overrides the default `https://updates.maxmind.com` MaxMind update
+	// server. Only used when `account_id`/`api_key` are set.
+	UpdateURL string `json:"update_url"`
+
 	// The frequency to download a fresh version of the database file
 	DownloadFrequency caddy.Duration `json:"download_frequency"`
 
+	// The frequency to download a fresh version of the ASN database file
+	AsnDownloadFrequency caddy.Duration `json:"asn_download_frequency"`
+
 	// The frequency to reload the database file
 	ReloadFrequency caddy.Duration `json:"reload_frequency"`
 
+	// The number of decoded lookups to keep in the LRU cache. Default 10000.
+	CacheSize int `json:"cache_size"`
+
 	// The header to trust instead of the `RemoteAddr`
 	TrustHeader string `json:"trust_header"`
 
@@ -86,22 +160,26 @@ func (m *GeoIP) Provision(ctx caddy.Context) error {
 	}
 
 	tmp, _, err := pool.LoadOrNew("geoip.state", func() (caddy.Destructor, error) {
-		state := state{
-			logger: ctx.Logger(m),
-		}
-		state.Provision(m)
-		return &state, nil
+		return &state{logger: ctx.Logger(m)}, nil
 	})
 	if err != nil {
 		m.logger.Error("unable to load previous state", zap.Error(err))
 		return err
 	}
 
-	if state, ok := tmp.(*state); ok {
-		m.state = state
-		state.logStatus()
+	s, ok := tmp.(*state)
+	if !ok {
+		return fmt.Errorf("unexpected type in geoip state pool: %T", tmp)
+	}
+
+	if err := s.ensureProvisioned(m); err != nil {
+		m.logger.Error("unable to provision state", zap.Error(err))
+		return err
 	}
 
+	m.state = s
+	s.logStatus()
+
 	return nil
 }
 
@@ -125,11 +203,24 @@ func (m *GeoIP) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp
 		return next.ServeHTTP(w, r)
 	}
 
-	if m.state.dbInst == nil {
+	lookupStart := time.Now()
+	entry, hit, err := m.state.lookup(addr)
+	lookupDuration.Observe(time.Since(lookupStart).Seconds())
+	if err == errNoDatabase {
+		lookupsTotal.WithLabelValues("nodb").Inc()
 		m.logger.Warn("no database loaded, skipping geoip lookup")
 
 		repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
 		repl.Set("geoip.country_code", "--")
+		repl.Set("geoip.city", "")
+		repl.Set("geoip.subdivision_code", "")
+		repl.Set("geoip.postal_code", "")
+		repl.Set("geoip.latitude", "")
+		repl.Set("geoip.longitude", "")
+		repl.Set("geoip.time_zone", "")
+		repl.Set("geoip.accuracy_radius", "")
+		repl.Set("geoip.asn", "0")
+		repl.Set("geoip.aso", "--")
 
 		// local development - force the country code to a known value
 		if m.OverrideCountryCode != "" {
@@ -138,21 +229,33 @@ func (m *GeoIP) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp
 
 		return next.ServeHTTP(w, r)
 	}
-
-	var record Record
-	err = m.state.dbInst.Lookup(addr, &record)
 	if err != nil {
+		lookupsTotal.WithLabelValues("error").Inc()
 		m.logger.Warn("cannot lookup IP address", zap.String("address", r.RemoteAddr), zap.Error(err))
 		return err
 	}
+	if hit {
+		lookupsTotal.WithLabelValues("hit").Inc()
+	} else {
+		lookupsTotal.WithLabelValues("miss").Inc()
+	}
+	record := entry.record
 
 	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
 	repl.Set("geoip.country_code", record.Country.ISOCode)
+	repl.Set("geoip.city", record.cityName())
+	repl.Set("geoip.subdivision_code", record.subdivisionCode())
+	repl.Set("geoip.postal_code", record.Postal.Code)
+	repl.Set("geoip.latitude", record.Location.Latitude)
+	repl.Set("geoip.longitude", record.Location.Longitude)
+	repl.Set("geoip.time_zone", record.Location.TimeZone)
+	repl.Set("geoip.accuracy_radius", record.Location.AccuracyRadius)
 
 	m.logger.Debug(
 		"found maxmind data",
 		zap.String("ip", r.RemoteAddr),
 		zap.String("country", record.Country.ISOCode),
+		zap.String("city", record.cityName()),
 	)
 
 	// local development - force the country code to a known value
@@ -160,5 +263,14 @@ func (m *GeoIP) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp
 		repl.Set("geoip.country_code", m.OverrideCountryCode)
 	}
 
+	if !entry.hasAsn {
+		repl.Set("geoip.asn", "0")
+		repl.Set("geoip.aso", "--")
+		return next.ServeHTTP(w, r)
+	}
+
+	repl.Set("geoip.asn", entry.asnRecord.AutonomousSystemNumber)
+	repl.Set("geoip.aso", entry.asnRecord.AutonomousSystemOrganization)
+
 	return next.ServeHTTP(w, r)
 }
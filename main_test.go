@@ -135,6 +135,44 @@ func TestIPV4Caddyfile(t *testing.T) {
 	tester.AssertResponse(req, 200, "Hello from NZ")
 }
 
+// TestIPV4CaddyfileAsn checks that configuring asn_db_path populates the
+// geoip.asn/geoip.aso placeholders from a GeoLite2-ASN.mmdb fixture.
+func TestIPV4CaddyfileAsn(t *testing.T) {
+	tester := caddytest.NewTester(t)
+
+	cfg := `
+		{
+			http_port     8080
+			https_port    8443
+			order geo_ip first
+		}
+
+		localhost:8080 {
+
+			geo_ip {
+				reload_frequency 	1d
+			  db_path 					GeoLite2-Country.mmdb
+				asn_db_path 			GeoLite2-ASN.mmdb
+				trust_header 			X-Real-IP
+			}
+
+			respond / 200 {
+				body "asn=[{geoip.asn}] aso=[{geoip.aso}]"
+			}
+		}
+	`
+
+	tester.InitServer(cfg, "caddyfile")
+
+	req, err := http.NewRequest("GET", "http://localhost:8080", nil)
+	if err != nil {
+		t.Fatalf("unable to create request %s", err)
+	}
+
+	req.Header.Add("X-Real-IP", "1.1.1.1:3000")
+	tester.AssertResponse(req, 200, "asn=[13335] aso=[Cloudflare, Inc.]")
+}
+
 func TestIPV4CaddyfileOverride(t *testing.T) {
 	tester := caddytest.NewTester(t)
 
@@ -170,6 +208,46 @@ func TestIPV4CaddyfileOverride(t *testing.T) {
 	tester.AssertResponse(req, 200, "Hello from AU")
 }
 
+// TestIPV4CaddyfileCityPlaceholders checks the city/subdivision/postal/
+// location placeholders against a GeoLite2-Country.mmdb fixture, which
+// carries none of that data - the text ones should render empty and the
+// numeric ones (latitude, longitude, accuracy radius) as 0, rather than
+// error or fall back to some other sentinel.
+func TestIPV4CaddyfileCityPlaceholders(t *testing.T) {
+	tester := caddytest.NewTester(t)
+
+	cfg := `
+		{
+			http_port     8080
+			https_port    8443
+			order geo_ip first
+		}
+
+		localhost:8080 {
+
+			geo_ip {
+				reload_frequency 	1d
+			  db_path 					GeoLite2-Country.mmdb
+				trust_header 			X-Real-IP
+			}
+
+			respond / 200 {
+				body "city=[{geoip.city}] subdivision=[{geoip.subdivision_code}] postal=[{geoip.postal_code}] lat=[{geoip.latitude}] lon=[{geoip.longitude}] tz=[{geoip.time_zone}] radius=[{geoip.accuracy_radius}]"
+			}
+		}
+	`
+
+	tester.InitServer(cfg, "caddyfile")
+
+	req, err := http.NewRequest("GET", "http://localhost:8080", nil)
+	if err != nil {
+		t.Fatalf("unable to create request %s", err)
+	}
+
+	req.Header.Add("X-Real-IP", "202.36.75.151:3000")
+	tester.AssertResponse(req, 200, "city=[] subdivision=[] postal=[] lat=[0] lon=[0] tz=[] radius=[0]")
+}
+
 func TestDatabaseDoesNotExist(t *testing.T) {
 	tester := caddytest.NewTester(t)
 
@@ -0,0 +1,247 @@
+package caddy_geoip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+
+	"go.uber.org/zap"
+)
+
+// Interface guards
+var (
+	_ caddy.Module             = (*Matcher)(nil)
+	_ caddy.Provisioner        = (*Matcher)(nil)
+	_ caddyhttp.RequestMatcher = (*Matcher)(nil)
+	_ caddyfile.Unmarshaler    = (*Matcher)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(Matcher{})
+}
+
+// Matcher is a request matcher that matches requests by the country or ASN
+// of the client IP. It reuses the same shared GeoIP database state as the
+// `geoip` handler, so it does not open its own copy of the database.
+type Matcher struct {
+	// The ISO country codes to match against, e.g. CN, RU.
+	Countries []string `json:"countries,omitempty"`
+
+	// The autonomous system numbers to match against, e.g. 13335.
+	Asns []uint `json:"asns,omitempty"`
+
+	// If true, match when the client IP's country/ASN is NOT found in the
+	// lists above, instead of when it is.
+	Negate bool `json:"negate,omitempty"`
+
+	// IPs or CIDR ranges that always match, regardless of country/ASN -
+	// useful to bypass the matcher for internal networks.
+	Bypass []string `json:"bypass,omitempty"`
+
+	// The header to trust instead of the `RemoteAddr`
+	TrustHeader string `json:"trust_header,omitempty"`
+
+	bypassCidrs []*net.IPNet
+	logger      *zap.Logger
+	state       *state
+}
+
+func (Matcher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.geoip",
+		New: func() caddy.Module { return new(Matcher) },
+	}
+}
+
+func (m *Matcher) Provision(ctx caddy.Context) error {
+	m.logger = ctx.Logger(m)
+
+	for _, str := range m.Bypass {
+		if strings.Contains(str, "/") {
+			_, ipNet, err := net.ParseCIDR(str)
+			if err != nil {
+				return fmt.Errorf("parsing bypass CIDR expression: %v", err)
+			}
+			m.bypassCidrs = append(m.bypassCidrs, ipNet)
+		} else {
+			ip := net.ParseIP(str)
+			if ip == nil {
+				return fmt.Errorf("invalid bypass IP address: %s", str)
+			}
+			mask := len(ip) * 8
+			m.bypassCidrs = append(m.bypassCidrs, &net.IPNet{
+				IP:   ip,
+				Mask: net.CIDRMask(mask, mask),
+			})
+		}
+	}
+
+	// Share the same state as the geoip handler so we don't reopen the
+	// database. If no geoip handler has been provisioned yet - plausible,
+	// since Caddy provisions modules in route order, not Caddyfile
+	// declaration order - this creates an unconfigured placeholder; it
+	// becomes live once some geoip handler's own Provision runs (see
+	// state.ensureProvisioned), whether that happens before or after this
+	// one. Until then, lookups behave as if no database were loaded, same
+	// as the handler does in that situation.
+	tmp, _, err := pool.LoadOrNew("geoip.state", func() (caddy.Destructor, error) {
+		return &state{logger: m.logger}, nil
+	})
+	if err != nil {
+		m.logger.Error("unable to load geoip state", zap.Error(err))
+		return err
+	}
+
+	if s, ok := tmp.(*state); ok {
+		m.state = s
+	}
+
+	return nil
+}
+
+func (m Matcher) getClientIP(r *http.Request) (net.IP, error) {
+	remote := r.RemoteAddr
+	if m.TrustHeader != "" && r.Header.Get(m.TrustHeader) != "" {
+		remote = r.Header.Get(m.TrustHeader)
+	}
+
+	ipStr, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		ipStr = remote // OK; probably didn't have a port
+	}
+
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid client IP address: %s", ipStr)
+	}
+	return ip, nil
+}
+
+func (m Matcher) bypasses(ip net.IP) bool {
+	for _, ipRange := range m.bypassCidrs {
+		if ipRange.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m Matcher) matchesCountry(ip net.IP) bool {
+	if len(m.Countries) == 0 {
+		return false
+	}
+	if m.state == nil {
+		return false
+	}
+
+	var record Record
+	if err := m.state.lookupCountry(ip, &record); err != nil {
+		if err != errNoDatabase {
+			m.logger.Error("looking up country for ip", zap.String("ip", ip.String()), zap.Error(err))
+		}
+		return false
+	}
+
+	for _, country := range m.Countries {
+		if strings.EqualFold(country, record.Country.ISOCode) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m Matcher) matchesAsn(ip net.IP) bool {
+	if len(m.Asns) == 0 {
+		return false
+	}
+	if m.state == nil {
+		return false
+	}
+
+	var asnRecord AsnRecord
+	if err := m.state.lookupAsn(ip, &asnRecord); err != nil {
+		if err != errNoDatabase {
+			m.logger.Error("looking up asn for ip", zap.String("ip", ip.String()), zap.Error(err))
+		}
+		return false
+	}
+
+	for _, asn := range m.Asns {
+		if asn == asnRecord.AutonomousSystemNumber {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns true if r's client IP matches the configured countries/ASNs
+// (inverted when Negate is set), or always if it falls in a Bypass range.
+func (m Matcher) Match(r *http.Request) bool {
+	clientIP, err := m.getClientIP(r)
+	if err != nil {
+		m.logger.Error("getting client IP", zap.Error(err))
+		return false
+	}
+
+	if m.bypasses(clientIP) {
+		return true
+	}
+
+	matched := m.matchesCountry(clientIP) || m.matchesAsn(clientIP)
+	if m.Negate {
+		return !matched
+	}
+	return matched
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	geoip country CN RU
+//	geoip asn 13335 15169
+//	geoip negate
+//	geoip bypass 10.0.0.0/8
+//	geoip trust_header X-Real-IP
+func (m *Matcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return d.ArgErr()
+		}
+
+		switch args[0] {
+		case "country":
+			m.Countries = append(m.Countries, args[1:]...)
+
+		case "asn":
+			for _, a := range args[1:] {
+				n, err := strconv.ParseUint(a, 10, 32)
+				if err != nil {
+					return d.Errf("invalid asn %s: %v", a, err)
+				}
+				m.Asns = append(m.Asns, uint(n))
+			}
+
+		case "negate":
+			m.Negate = true
+
+		case "bypass":
+			m.Bypass = append(m.Bypass, args[1:]...)
+
+		case "trust_header":
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			m.TrustHeader = args[1]
+
+		default:
+			return d.Errf("unrecognized geoip matcher option '%s'", args[0])
+		}
+	}
+	return nil
+}
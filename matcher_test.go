@@ -0,0 +1,164 @@
+package caddy_geoip
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddytest"
+)
+
+func TestMatcherCountryCaddyfile(t *testing.T) {
+	tester := caddytest.NewTester(t)
+
+	cfg := `
+		{
+			http_port     8080
+			https_port    8443
+			order geo_ip first
+		}
+
+		localhost:8080 {
+
+			geo_ip {
+				db_path 					GeoLite2-Country.mmdb
+				trust_header 			X-Real-IP
+			}
+
+			@nz {
+				geoip country NZ
+				geoip trust_header X-Real-IP
+			}
+
+			respond @nz "blocked" 200
+		}
+	`
+
+	tester.InitServer(cfg, "caddyfile")
+
+	req, err := http.NewRequest("GET", "http://localhost:8080", nil)
+	if err != nil {
+		t.Fatalf("unable to create request %s", err)
+	}
+
+	req.Header.Add("X-Real-IP", "202.36.75.151:3000")
+	tester.AssertResponse(req, 200, "blocked")
+}
+
+func TestMatcherAsnCaddyfile(t *testing.T) {
+	tester := caddytest.NewTester(t)
+
+	cfg := `
+		{
+			http_port     8080
+			https_port    8443
+			order geo_ip first
+		}
+
+		localhost:8080 {
+
+			geo_ip {
+				db_path 					GeoLite2-Country.mmdb
+				asn_db_path 			GeoLite2-ASN.mmdb
+				trust_header 			X-Real-IP
+			}
+
+			@cloudflare {
+				geoip asn 13335
+				geoip trust_header X-Real-IP
+			}
+
+			respond @cloudflare "blocked" 200
+		}
+	`
+
+	tester.InitServer(cfg, "caddyfile")
+
+	req, err := http.NewRequest("GET", "http://localhost:8080", nil)
+	if err != nil {
+		t.Fatalf("unable to create request %s", err)
+	}
+
+	req.Header.Add("X-Real-IP", "1.1.1.1:3000")
+	tester.AssertResponse(req, 200, "blocked")
+}
+
+func TestMatcherBypassCaddyfile(t *testing.T) {
+	tester := caddytest.NewTester(t)
+
+	cfg := `
+		{
+			http_port     8080
+			https_port    8443
+			order geo_ip first
+		}
+
+		localhost:8080 {
+
+			geo_ip {
+				db_path 					GeoLite2-Country.mmdb
+				trust_header 			X-Real-IP
+			}
+
+			@notnz {
+				geoip country NZ
+				geoip negate
+				geoip bypass 10.0.0.0/8
+				geoip trust_header X-Real-IP
+			}
+
+			respond @notnz "not nz" 200
+			respond "is nz" 200
+		}
+	`
+
+	tester.InitServer(cfg, "caddyfile")
+
+	req, err := http.NewRequest("GET", "http://localhost:8080", nil)
+	if err != nil {
+		t.Fatalf("unable to create request %s", err)
+	}
+
+	// 10.0.0.0/8 isn't NZ, but bypasses() short-circuits Match() to true
+	// before negate is ever applied, so the matcher fires regardless.
+	req.Header.Add("X-Real-IP", "10.1.2.3:3000")
+	tester.AssertResponse(req, 200, "not nz")
+}
+
+func TestMatcherNegateCaddyfile(t *testing.T) {
+	tester := caddytest.NewTester(t)
+
+	cfg := `
+		{
+			http_port     8080
+			https_port    8443
+			order geo_ip first
+		}
+
+		localhost:8080 {
+
+			geo_ip {
+				db_path 					GeoLite2-Country.mmdb
+				trust_header 			X-Real-IP
+			}
+
+			@notnz {
+				geoip country NZ
+				geoip negate
+				geoip trust_header X-Real-IP
+			}
+
+			respond @notnz "not nz" 200
+			respond "is nz" 200
+		}
+	`
+
+	tester.InitServer(cfg, "caddyfile")
+
+	req, err := http.NewRequest("GET", "http://localhost:8080", nil)
+	if err != nil {
+		t.Fatalf("unable to create request %s", err)
+	}
+
+	req.Header.Add("X-Real-IP", "202.36.75.151:3000")
+	tester.AssertResponse(req, 200, "is nz")
+}
@@ -0,0 +1,29 @@
+package caddy_geoip
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	lookupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "caddy_geoip_lookups_total",
+		Help: "Total number of geoip lookups, labeled by result (hit, miss, error, nodb).",
+	}, []string{"result"})
+
+	lookupDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "caddy_geoip_lookup_duration_seconds",
+		Help: "Time spent performing a geoip database lookup.",
+	})
+
+	dbReloadTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "caddy_geoip_db_reload_timestamp",
+		Help: "Unix timestamp of the last successful database reload.",
+	})
+
+	dbBuildEpoch = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "caddy_geoip_db_build_epoch",
+		Help: "Build epoch reported by the currently loaded database's metadata.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(lookupsTotal, lookupDuration, dbReloadTimestamp, dbBuildEpoch)
+}
@@ -0,0 +1,87 @@
+package caddy_geoip
+
+import (
+	"sync"
+	"time"
+)
+
+// idleBucketTTL is how long a key's bucket may sit unused before it is
+// evicted. Without this, rateLimiter.buckets grows one entry per distinct
+// key forever - an easy unbounded-memory vector for any caller that can
+// vary its key per request.
+const idleBucketTTL = 5 * time.Minute
+
+// rateLimiter is a simple per-key token bucket limiter used to protect the
+// lookup API from being hammered by a single client IP.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64 // tokens added per second
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	// a bucket needs room for at least one whole token, or a rate below 1
+	// would never allow a single request
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow reports whether a request from key should be allowed, consuming a
+// token from its bucket if so.
+func (l *rateLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.evictIdleLocked(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, lastSeen: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.lastSeen).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.lastSeen = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// evictIdleLocked drops buckets that have sat idle longer than
+// idleBucketTTL, bounding l.buckets' memory even under a large number of
+// distinct keys. It sweeps at most once per idleBucketTTL window, so the
+// cost is amortized rather than paid on every call. l.mu must be held.
+func (l *rateLimiter) evictIdleLocked(now time.Time) {
+	if now.Sub(l.lastSweep) < idleBucketTTL {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if now.Sub(b.lastSeen) > idleBucketTTL {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package caddy_geoip
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := newRateLimiter(1)
+
+	if !l.Allow("a") {
+		t.Fatal("expected first request to be allowed")
+	}
+	if l.Allow("a") {
+		t.Fatal("expected second immediate request to be denied")
+	}
+}
+
+func TestRateLimiterPerKeyIndependent(t *testing.T) {
+	l := newRateLimiter(1)
+
+	if !l.Allow("a") {
+		t.Fatal("expected first request for key a to be allowed")
+	}
+	if !l.Allow("b") {
+		t.Fatal("expected first request for key b to be allowed, independent of key a")
+	}
+}
+
+func TestRateLimiterEvictsIdleBuckets(t *testing.T) {
+	l := newRateLimiter(10)
+
+	l.Allow("stale")
+	l.buckets["stale"].lastSeen = time.Now().Add(-2 * idleBucketTTL)
+	l.lastSweep = time.Now().Add(-2 * idleBucketTTL)
+
+	l.Allow("fresh")
+
+	if _, ok := l.buckets["stale"]; ok {
+		t.Fatal("expected idle bucket to be evicted")
+	}
+	if _, ok := l.buckets["fresh"]; !ok {
+		t.Fatal("expected fresh bucket to survive the sweep")
+	}
+}
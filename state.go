@@ -3,49 +3,185 @@ package caddy_geoip
 import (
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/hashicorp/golang-lru"
 	"github.com/maxmind/geoipupdate/v4/pkg/geoipupdate"
 	"github.com/maxmind/geoipupdate/v4/pkg/geoipupdate/database"
 	"github.com/oschwald/maxminddb-golang"
 	"go.uber.org/zap"
 )
 
+const defaultUpdateURL = "https://updates.maxmind.com"
+
+// defaultCacheSize is the number of decoded Records kept in the lookup
+// cache when `cache_size` isn't set.
+const defaultCacheSize = 10000
+
+// dbSource describes where a database file comes from: a local path
+// (optionally given as a file:// URL), or an http(s):// mirror that is
+// polled for updates on every reload instead of going through the MaxMind
+// geoipupdate protocol.
+type dbSource struct {
+	raw    string
+	local  string // local filesystem path the mmdb is opened from
+	remote string // non-empty for http(s) sources: the URL to poll
+
+	etag         string
+	lastModified string
+}
+
+// newDbSource parses a `db_path`/`asn_db_path` value, which may be a plain
+// filesystem path, a `file://` URL, or an `http(s)://` URL.
+func newDbSource(raw string) (dbSource, error) {
+	if raw == "" {
+		return dbSource{}, nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return dbSource{}, fmt.Errorf("parsing db source %q: %w", raw, err)
+	}
+
+	switch u.Scheme {
+	case "":
+		return dbSource{raw: raw, local: raw}, nil
+
+	case "file":
+		return dbSource{raw: raw, local: u.Path}, nil
+
+	case "http", "https":
+		return dbSource{
+			raw:    raw,
+			local:  filepath.Join(os.TempDir(), "caddy-geoip-"+filepath.Base(u.Path)),
+			remote: raw,
+		}, nil
+
+	default:
+		return dbSource{}, fmt.Errorf("unsupported db source scheme %q in %q", u.Scheme, raw)
+	}
+}
+
 type state struct {
-	mu     sync.Mutex
-	dbInst *maxminddb.Reader
-	done   chan bool
-	dbPath string
+	// mu guards provisioned and the reader instances below. Reloads take
+	// the write lock while swapping and closing the old reader; lookups
+	// take the read lock for the duration of the Lookup call, so a reload
+	// can never close a reader out from under an in-flight request.
+	mu          sync.RWMutex
+	provisioned bool
+	dbInst      *maxminddb.Reader
+	asnDbInst   *maxminddb.Reader
+	done        chan bool
+
+	db    dbSource
+	asnDb dbSource
+
+	// editionPaths maps a geoipupdate EditionID to the local file it should
+	// be downloaded/reloaded from, e.g. "GeoLite2-Country" -> state.db.local.
+	editionPaths map[string]string
+
+	// cache holds decoded Records keyed by the 16-byte IP they were looked
+	// up for, so repeat visitors don't re-traverse the mmdb trie on every
+	// request. It is purged whenever the database is reloaded.
+	cache *lru.Cache
 
 	config *geoipupdate.Config
 
 	logger *zap.Logger
 }
 
+// ensureProvisioned runs Provision(m) exactly once for the life of this
+// state, regardless of which module reaches it first. Caddy provisions
+// modules in route-traversal order, not Caddyfile declaration order, so the
+// geoip matcher or geoip_api handler can easily be provisioned before the
+// geoip handler that owns the database configuration. Without this, the
+// pool would permanently wedge on whichever inert, unconfigured state won
+// that race: the constructor passed to pool.LoadOrNew only ever runs for
+// the first caller, so a later geoip handler's own Provision would just
+// get the same un-opened database handed back.
+func (state *state) ensureProvisioned(m *GeoIP) error {
+	state.mu.Lock()
+	if state.provisioned {
+		state.mu.Unlock()
+		return nil
+	}
+	state.provisioned = true
+	state.mu.Unlock()
+
+	return state.Provision(m)
+}
+
 func (state *state) Provision(m *GeoIP) error {
 
 	state.done = make(chan bool, 1)
-	state.dbPath = m.DbPath
+	state.editionPaths = map[string]string{}
+
+	cacheSize := m.CacheSize
+	if cacheSize <= 0 {
+		cacheSize = defaultCacheSize
+	}
+	cache, err := lru.New(cacheSize)
+	if err != nil {
+		return fmt.Errorf("creating lookup cache: %w", err)
+	}
+	state.cache = cache
+
+	db, err := newDbSource(m.DbPath)
+	if err != nil {
+		return err
+	}
+	state.db = db
+
+	asnDb, err := newDbSource(m.AsnDbPath)
+	if err != nil {
+		return err
+	}
+	state.asnDb = asnDb
+
+	updateURL := defaultUpdateURL
+	if m.UpdateURL != "" {
+		updateURL = m.UpdateURL
+	}
 
 	// start the reload or the refresh timer
 	if m.AccountID > 0 && m.APIKey != "" && m.DownloadFrequency > 0 {
 
 		state.logger.Info("starting download ticker", zap.Duration("frequency", time.Duration(m.DownloadFrequency)))
-		directoryPath, filename := filepath.Split(state.dbPath)
+		directoryPath, filename := filepath.Split(state.db.local)
 
 		edition := strings.Replace(filename, ".mmdb", "", 1)
+		state.editionPaths[edition] = state.db.local
+		editionIDs := []string{edition}
+		mainEditionIDs := []string{edition}
+
+		// when asn_download_frequency is set, the ASN edition gets its own
+		// ticker below instead of riding along with the main one.
+		var asnEdition string
+		if state.asnDb.raw != "" {
+			_, asnFilename := filepath.Split(state.asnDb.local)
+			asnEdition = strings.Replace(asnFilename, ".mmdb", "", 1)
+			state.editionPaths[asnEdition] = state.asnDb.local
+			editionIDs = append(editionIDs, asnEdition)
+			if m.AsnDownloadFrequency <= 0 {
+				mainEditionIDs = append(mainEditionIDs, asnEdition)
+			}
+		}
 
 		state.config = &geoipupdate.Config{
 			AccountID:         m.AccountID,
 			DatabaseDirectory: directoryPath,
 			LicenseKey:        m.APIKey,
 			LockFile:          filepath.Join(directoryPath, ".geoipupdate.lock"),
-			URL:               "https://updates.maxmind.com",
-			EditionIDs:        []string{edition},
+			URL:               updateURL,
+			EditionIDs:        editionIDs,
 			Proxy:             nil,
 			PreserveFileTimes: true,
 			Verbose:           true,
@@ -60,8 +196,7 @@ func (state *state) Provision(m *GeoIP) error {
 			for {
 				select {
 				case <-ticker.C:
-					err := state.downloadDatabase()
-					if err != nil {
+					if err := state.downloadEditions(mainEditionIDs); err != nil {
 						state.logger.Error("downloading database failed", zap.Error(err))
 					}
 				case <-state.done:
@@ -71,7 +206,27 @@ func (state *state) Provision(m *GeoIP) error {
 			}
 		}()
 
-		return state.downloadDatabase()
+		if asnEdition != "" && m.AsnDownloadFrequency > 0 {
+			state.logger.Info("starting asn download ticker", zap.Duration("frequency", time.Duration(m.AsnDownloadFrequency)))
+
+			go func() {
+				ticker := time.NewTicker(time.Duration(m.AsnDownloadFrequency))
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ticker.C:
+						if err := state.downloadEditions([]string{asnEdition}); err != nil {
+							state.logger.Error("downloading asn database failed", zap.Error(err))
+						}
+					case <-state.done:
+						state.logger.Info("asn downloading stopped")
+						return
+					}
+				}
+			}()
+		}
+
+		return state.downloadEditions(editionIDs)
 	} else if m.ReloadFrequency > 0 {
 
 		// start the reload frequency
@@ -97,7 +252,7 @@ func (state *state) Provision(m *GeoIP) error {
 	}
 
 	// assume the database is local
-	err := state.reloadDatabase()
+	err = state.reloadDatabase()
 	if err != nil {
 		return fmt.Errorf("cannot open database file %s: %v", m.DbPath, err)
 	}
@@ -110,51 +265,224 @@ func (state *state) reloadDatabase() error {
 	state.mu.Lock()
 	defer state.mu.Unlock()
 
-	if _, err := os.Stat(state.dbPath); errors.Is(err, os.ErrNotExist) {
-		state.logger.Warn("database does not exist", zap.String("dbpath", state.dbPath))
+	if err := state.reloadOne(&state.db, &state.dbInst, "database"); err != nil {
+		return err
+	}
+
+	if state.asnDb.raw == "" {
 		return nil
 	}
 
-	newInstance, err := maxminddb.Open(state.dbPath)
+	return state.reloadOne(&state.asnDb, &state.asnDbInst, "asn database")
+}
+
+// reloadOne re-fetches (if src is a remote mirror) and (re-)opens a single
+// database, swapping it into *inst and closing the previous instance.
+func (state *state) reloadOne(src *dbSource, inst **maxminddb.Reader, label string) error {
+	if src.remote != "" {
+		fetched, err := state.fetchRemote(src)
+		if err != nil {
+			// keep serving the last good copy rather than failing the reload
+			state.logger.Error("fetching remote "+label, zap.String("url", src.remote), zap.Error(err))
+			return nil
+		}
+		if !fetched {
+			state.logger.Debug(label + " not modified")
+			return nil
+		}
+	}
+
+	newInstance, err := state.openDatabase(src.local)
 	if err != nil {
 		return err
 	}
+	if newInstance == nil {
+		return nil
+	}
 
-	// keep a reference to the old instance
-	oldInstance := state.dbInst
-	state.dbInst = newInstance
-
+	oldInstance := *inst
+	*inst = newInstance
 	if oldInstance != nil {
-		state.logger.Info("closing old database")
-		return oldInstance.Close()
+		state.logger.Info("closing old " + label)
+		if err := oldInstance.Close(); err != nil {
+			return err
+		}
+	}
+
+	// the decoded Records cached from the previous database are no longer
+	// valid once any database is swapped in.
+	state.cache.Purge()
+
+	if inst == &state.dbInst {
+		dbReloadTimestamp.SetToCurrentTime()
+		dbBuildEpoch.Set(float64(newInstance.Metadata.BuildEpoch))
 	}
 
-	state.logger.Info("reload successful",
-		zap.Uint("epoch", state.dbInst.Metadata.BuildEpoch),
-		zap.Uint("major", state.dbInst.Metadata.BinaryFormatMajorVersion),
-		zap.Uint("minor", state.dbInst.Metadata.BinaryFormatMinorVersion))
+	state.logger.Info(label+" reload successful",
+		zap.String("type", newInstance.Metadata.DatabaseType),
+		zap.Uint("epoch", newInstance.Metadata.BuildEpoch),
+		zap.Uint("major", newInstance.Metadata.BinaryFormatMajorVersion),
+		zap.Uint("minor", newInstance.Metadata.BinaryFormatMinorVersion))
 
 	return nil
 }
 
-func (state *state) downloadDatabase() error {
-	edition := state.config.EditionIDs[0]
+// errNoDatabase is returned by lookupCountry/lookupAsn when no database of
+// the corresponding kind has been loaded yet.
+var errNoDatabase = errors.New("no database loaded")
 
-	state.logger.Info("starting download", zap.String("edition", edition))
+// lookupCountry looks addr up against the country/city database. It holds
+// state.mu for the duration of the Lookup call so a concurrent reload
+// cannot close the reader out from under it.
+func (state *state) lookupCountry(addr net.IP, out *Record) error {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	if state.dbInst == nil {
+		return errNoDatabase
+	}
+	return state.dbInst.Lookup(addr, out)
+}
 
-	client := geoipupdate.NewClient(state.config)
-	dbReader := database.NewHTTPDatabaseReader(client, state.config)
+// lookupAsn looks addr up against the ASN database, under the same read
+// lock as lookupCountry.
+func (state *state) lookupAsn(addr net.IP, out *AsnRecord) error {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	if state.asnDbInst == nil {
+		return errNoDatabase
+	}
+	return state.asnDbInst.Lookup(addr, out)
+}
+
+// cacheEntry is what state.cache stores per IP: the decoded country/city
+// Record, plus the AsnRecord when an ASN database is loaded.
+type cacheEntry struct {
+	record    Record
+	asnRecord AsnRecord
+	hasAsn    bool
+}
+
+// lookup resolves addr against the loaded database(s), serving a previously
+// decoded result from state.cache when one is present. The returned bool
+// reports whether this was a cache hit.
+func (state *state) lookup(addr net.IP) (cacheEntry, bool, error) {
+	key := string(addr.To16())
+
+	if cached, ok := state.cache.Get(key); ok {
+		return cached.(cacheEntry), true, nil
+	}
+
+	var entry cacheEntry
+	if err := state.lookupCountry(addr, &entry.record); err != nil {
+		return cacheEntry{}, false, err
+	}
+
+	if err := state.lookupAsn(addr, &entry.asnRecord); err == nil {
+		entry.hasAsn = true
+	} else if err != errNoDatabase {
+		return cacheEntry{}, false, err
+	}
+
+	state.cache.Add(key, entry)
+	return entry, false, nil
+}
+
+// openDatabase opens the mmdb file at path, or returns a nil reader (and no
+// error) if the file does not yet exist on disk.
+func (state *state) openDatabase(path string) (*maxminddb.Reader, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		state.logger.Warn("database does not exist", zap.String("dbpath", path))
+		return nil, nil
+	}
+
+	return maxminddb.Open(path)
+}
+
+// fetchRemote downloads src.remote into src.local, honouring ETag/
+// If-Modified-Since so unchanged mirrors are a cheap no-op. It returns
+// whether a new file was written.
+func (state *state) fetchRemote(src *dbSource) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, src.remote, nil)
+	if err != nil {
+		return false, err
+	}
+	if src.etag != "" {
+		req.Header.Set("If-None-Match", src.etag)
+	}
+	if src.lastModified != "" {
+		req.Header.Set("If-Modified-Since", src.lastModified)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status fetching %s: %s", src.remote, resp.Status)
+	}
 
-	dbWriter, err := database.NewLocalFileDatabaseWriter(state.dbPath, state.config.LockFile, state.config.Verbose)
+	if err := os.MkdirAll(filepath.Dir(src.local), 0o755); err != nil {
+		return false, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(src.local), "download-*")
 	if err != nil {
-		state.logger.Error("creating maxmind db writer", zap.Error(err))
+		return false, err
 	}
+	defer os.Remove(tmp.Name())
 
-	if err := dbReader.Get(dbWriter, edition); err != nil {
-		state.logger.Error("getting database", zap.Error(err))
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
 	}
 
-	state.logger.Info("finished download", zap.String("edition", edition))
+	if err := os.Rename(tmp.Name(), src.local); err != nil {
+		return false, err
+	}
+
+	src.etag = resp.Header.Get("ETag")
+	src.lastModified = resp.Header.Get("Last-Modified")
+
+	return true, nil
+}
+
+// downloadEditions fetches the given geoipupdate editions (a subset of
+// state.config.EditionIDs) and reloads the database(s) afterwards. Editions
+// are split across separate tickers when asn_download_frequency is set, so
+// each ticker only re-downloads its own set.
+func (state *state) downloadEditions(editions []string) error {
+	client := geoipupdate.NewClient(state.config)
+	dbReader := database.NewHTTPDatabaseReader(client, state.config)
+
+	for _, edition := range editions {
+		dbPath, ok := state.editionPaths[edition]
+		if !ok {
+			state.logger.Error("no database path configured for edition", zap.String("edition", edition))
+			continue
+		}
+
+		state.logger.Info("starting download", zap.String("edition", edition))
+
+		dbWriter, err := database.NewLocalFileDatabaseWriter(dbPath, state.config.LockFile, state.config.Verbose)
+		if err != nil {
+			state.logger.Error("creating maxmind db writer", zap.Error(err))
+			continue
+		}
+
+		if err := dbReader.Get(dbWriter, edition); err != nil {
+			state.logger.Error("getting database", zap.Error(err))
+		}
+
+		state.logger.Info("finished download", zap.String("edition", edition))
+	}
 
 	return state.reloadDatabase()
 }
@@ -168,6 +496,17 @@ func (state *state) logStatus() {
 			zap.Uint("major", state.dbInst.Metadata.BinaryFormatMajorVersion),
 			zap.Uint("minor", state.dbInst.Metadata.BinaryFormatMinorVersion))
 	}
+
+	if state.asnDb.raw != "" {
+		if state.asnDbInst == nil {
+			state.logger.Info("no asn database available")
+		} else {
+			state.logger.Debug("asn database available",
+				zap.Uint("epoch", state.asnDbInst.Metadata.BuildEpoch),
+				zap.Uint("major", state.asnDbInst.Metadata.BinaryFormatMajorVersion),
+				zap.Uint("minor", state.asnDbInst.Metadata.BinaryFormatMinorVersion))
+		}
+	}
 }
 
 func (state *state) Destruct() error {
@@ -181,7 +520,13 @@ func (state *state) Destruct() error {
 	}
 
 	if state.dbInst != nil {
-		return state.dbInst.Close()
+		if err := state.dbInst.Close(); err != nil {
+			return err
+		}
+	}
+
+	if state.asnDbInst != nil {
+		return state.asnDbInst.Close()
 	}
 
 	return nil